@@ -1,18 +1,104 @@
 package hooks
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
+	"golang.org/x/net/http/httpproxy"
 )
 
+// retryableStatusCodes are the HTTP status codes worth retrying the
+// installer download for; every other status but 200 (4xx auth/permission
+// errors, 3xx redirects the client did not follow, other 2xx codes, ...) is
+// treated as final.
+var retryableStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+const (
+	defaultDownloadRetries = 3
+	retryBackoffBase       = time.Second
+	retryBackoffCap        = 30 * time.Second
+)
+
+// defaultServiceName is the substring matched against bound service names
+// when no DT_SERVICE_NAME override is set.
+const defaultServiceName = "dynatrace"
+
+// archManifestKeys maps runtime.GOARCH to the technologies/process key Dynatrace
+// uses in manifest.json for that architecture.
+var archManifestKeys = map[string]string{
+	"amd64":   "linux-x86-64",
+	"arm64":   "linux-arm64",
+	"ppc64le": "linux-ppc64le",
+	"s390x":   "linux-s390",
+}
+
+// archInstallerQueries maps runtime.GOARCH to the "arch" query value
+// documented for the PaaS installer download URL (the API only recognizes
+// "all", "x86", "ppc" and "arm"). Architectures with no documented value
+// (e.g. s390x) are left out and fall back to "all" so the request isn't
+// rejected by an unsupported value.
+var archInstallerQueries = map[string]string{
+	"amd64":   "x86",
+	"arm64":   "arm",
+	"ppc64le": "ppc",
+}
+
+const defaultInstallerArchQuery = "all"
+
+func installerArchQuery(goarch string) string {
+	if query, present := archInstallerQueries[goarch]; present {
+		return query
+	}
+	return defaultInstallerArchQuery
+}
+
+// hashAlgorithms maps a Binary struct field name (lower-cased) to the hash
+// constructor used to verify it. verifyAgentChecksum checks every Binary
+// field whose lower-cased name is a key here, so another checksum needs only
+// a Binary field and an entry in this map; manifest fields that Binary does
+// not declare are not checked.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+// Binary describes a single downloadable artifact entry in manifest.json.
+type Binary struct {
+	Path       string `json:"path"`
+	Md5        string `json:"md5"`
+	Sha256     string `json:"sha256,omitempty"`
+	Version    string `json:"version"`
+	Binarytype string `json:"binarytype,omitempty"`
+}
+
 type Command interface {
 	Execute(string, io.Writer, io.Writer, string, ...string) error
 }
@@ -51,11 +137,16 @@ func (h DynatraceHook) AfterCompile(stager *libbuildpack.Stager) error {
 		apiurl = "https://" + credentials["environmentid"] + ".live.dynatrace.com/api"
 	}
 
-	url := apiurl + "/v1/deployment/installer/agent/unix/paas-sh/latest?include=nodejs&include=process&bitness=64&Api-Token=" + credentials["apitoken"]
+	manifestArch, present := archManifestKeys[runtime.GOARCH]
+	if !present {
+		return errors.New("Unsupported architecture for Dynatrace PaaS agent: " + runtime.GOARCH)
+	}
+
+	url := apiurl + "/v1/deployment/installer/agent/unix/paas-sh/latest?include=nodejs&include=process&bitness=64&arch=" + installerArchQuery(runtime.GOARCH) + "&Api-Token=" + credentials["apitoken"]
 	installerPath := filepath.Join(os.TempDir(), "paasInstaller.sh")
 
 	h.Log.Debug("Downloading '%s' to '%s'", url, installerPath)
-	err := h.downloadFile(url, installerPath)
+	err := h.downloadFile(url, installerPath, credentials)
 	if err != nil {
 		if skipErrors == "true" {
 			h.Log.Warning("Error during installer download, skipping installation")
@@ -83,13 +174,15 @@ func (h DynatraceHook) AfterCompile(stager *libbuildpack.Stager) error {
 	dynatraceEnvName := "dynatrace-env.sh"
 	installDir := "dynatrace/oneagent"
 	dynatraceEnvPath := filepath.Join(stager.DepDir(), "profile.d", dynatraceEnvName)
-	agentLibPath, err := h.agentPath(filepath.Join(stager.BuildDir(), installDir))
+	agentBinary, err := h.agentPath(filepath.Join(stager.BuildDir(), installDir), manifestArch)
 	if err != nil {
 		h.Log.Error("Manifest handling failed!")
 		return err
 	}
-	
-	agentLibPath = filepath.Join(installDir, agentLibPath)
+
+	h.Log.Info("Dynatrace PaaS agent version %s found.", agentBinary.Version)
+
+	agentLibPath := filepath.Join(installDir, agentBinary.Path)
 
 	_, err = os.Stat(filepath.Join(stager.BuildDir(), agentLibPath))
 	if os.IsNotExist(err) {
@@ -97,6 +190,12 @@ func (h DynatraceHook) AfterCompile(stager *libbuildpack.Stager) error {
 		return err
 	}
 
+	err = h.verifyAgentChecksum(filepath.Join(stager.BuildDir(), agentLibPath), agentBinary, skipErrors)
+	if err != nil {
+		h.Log.Error("Agent library checksum verification failed!")
+		return err
+	}
+
 	h.Log.BeginStep("Setting up Dynatrace PaaS agent injection...")
 	h.Log.Debug("Copy %s to %s", dynatraceEnvName, dynatraceEnvPath)
 	err = libbuildpack.CopyFile(filepath.Join(stager.BuildDir(), installDir, dynatraceEnvName), dynatraceEnvPath)
@@ -112,15 +211,39 @@ func (h DynatraceHook) AfterCompile(stager *libbuildpack.Stager) error {
 
 	defer f.Close()
 
-	h.Log.Debug("Write LD_PRELOAD...")
-	_, err = f.WriteString("\nexport LD_PRELOAD=${HOME}/" + agentLibPath)
-	if err != nil {
+	application := h.vcapApplication()
+
+	if err := h.writeExport(f, "LD_PRELOAD", "${HOME}/"+shellEscape(agentLibPath)); err != nil {
 		return err
 	}
 
-	h.Log.Debug("Write DT_HOST_ID...")
-	_, err = f.WriteString("\nexport DT_HOST_ID=" + h.appName() + "_${CF_INSTANCE_INDEX}")
-	if err != nil {
+	if err := h.writeExport(f, "DT_HOST_ID", shellEscape(h.appName())+"_${CF_INSTANCE_INDEX}"); err != nil {
+		return err
+	}
+
+	if err := h.writeExport(f, "DT_TAGS", shellEscape(strings.Join(h.hostTags(application, credentials), ","))); err != nil {
+		return err
+	}
+
+	if networkZone := credentials["networkzone"]; networkZone != "" {
+		if err := h.writeExport(f, "DT_NETWORK_ZONE", shellEscape(networkZone)); err != nil {
+			return err
+		}
+	}
+
+	if hostGroup := credentials["hostgroup"]; hostGroup != "" {
+		if err := h.writeExport(f, "DT_HOST_GROUP", shellEscape(hostGroup)); err != nil {
+			return err
+		}
+	}
+
+	if addTechnologies := credentials["addtechnologies"]; addTechnologies != "" {
+		if err := h.writeExport(f, "DT_ADDTECHNOLOGIES", shellEscape(addTechnologies)); err != nil {
+			return err
+		}
+	}
+
+	if err := h.writeExport(f, "DT_CUSTOM_PROP", h.customProperties(application, stager, credentials)); err != nil {
 		return err
 	}
 
@@ -129,6 +252,99 @@ func (h DynatraceHook) AfterCompile(stager *libbuildpack.Stager) error {
 	return nil
 }
 
+// writeExport appends `export name="value"` to the already-open profile.d
+// script f, which CF sources with a shell at container startup. value is
+// wrapped in double quotes so embedded whitespace (e.g. a CF org/space name
+// like "Shared Services") doesn't break the assignment into extra shell
+// words; callers are responsible for running shellEscape over any
+// untrusted substring they splice in, so that stray `"`, `` ` ``, `$` or
+// `\` characters can't break out of the quoting or trigger command
+// substitution. Deliberate `${VAR}` references (e.g. ${CF_INSTANCE_GUID})
+// are left unescaped so they still expand at runtime.
+func (h DynatraceHook) writeExport(f *os.File, name, value string) error {
+	h.Log.Debug("Write %s...", name)
+	_, err := f.WriteString("\nexport " + name + "=\"" + value + "\"")
+	return err
+}
+
+// shellEscape makes s safe to splice into the double-quoted value passed to
+// writeExport by escaping the characters that are still special inside
+// double quotes: backslash, double-quote, `$` (variable/command
+// substitution), and backtick (command substitution).
+func shellEscape(s string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"$", `\$`,
+		"`", "\\`",
+	)
+	return replacer.Replace(s)
+}
+
+// hostTags derives the DT_TAGS entries that identify this instance's place
+// in the CF topology, plus an optional operator-supplied "environment"
+// credential.
+func (h DynatraceHook) hostTags(application vcapApplication, credentials map[string]string) []string {
+	tags := []string{
+		"app=" + application.Name,
+		"space=" + application.SpaceName,
+		"org=" + application.OrganizationName,
+		"appguid=" + application.ApplicationID,
+	}
+
+	if environment := credentials["environment"]; environment != "" {
+		tags = append(tags, "environment="+environment)
+	}
+
+	return tags
+}
+
+// customProperties builds the DT_CUSTOM_PROP value: the buildpack version
+// and CF instance guid (so a restarted instance stays correlatable),
+// followed by any operator-supplied custom_properties, a JSON object of
+// string key/value pairs carried in the service credentials.
+func (h DynatraceHook) customProperties(application vcapApplication, stager *libbuildpack.Stager, credentials map[string]string) string {
+	props := []string{
+		"BuildpackVersion=" + shellEscape(h.buildpackVersion(stager)),
+		"CfInstanceGuid=${CF_INSTANCE_GUID}",
+	}
+
+	if raw := credentials["custom_properties"]; raw != "" {
+		var custom map[string]string
+		if err := json.Unmarshal([]byte(raw), &custom); err != nil {
+			h.Log.Warning("Could not parse custom_properties credential as a JSON object: %s", err)
+		} else {
+			keys := make([]string, 0, len(custom))
+			for key := range custom {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				props = append(props, shellEscape(key)+"="+shellEscape(custom[key]))
+			}
+		}
+	}
+
+	return strings.Join(props, " ")
+}
+
+// buildpackVersion reports the buildpack's own version so it can be
+// recorded as a Dynatrace custom property.
+func (h DynatraceHook) buildpackVersion(stager *libbuildpack.Stager) string {
+	version, err := stager.BuildpackVersion()
+	if err != nil {
+		return "unknown"
+	}
+
+	return version
+}
+
+// dtCredentials scans VCAP_SERVICES for bound services whose name contains
+// the service name substring (defaultServiceName, or DT_SERVICE_NAME to
+// support rebrands like "dt-prod") and that carry the required
+// environmentid/apitoken credentials. If more than one service matches,
+// DT_SERVICE_TAG selects among them by each candidate's "tag" credential;
+// without it (or with no match) the hook still refuses to guess.
 func (h DynatraceHook) dtCredentials() map[string]string {
 	type Service struct {
 		Name        string            `json:"name"`
@@ -141,11 +357,16 @@ func (h DynatraceHook) dtCredentials() map[string]string {
 		return nil
 	}
 
+	serviceName := os.Getenv("DT_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
 	var detectedServices []Service
 
 	for _, services := range vcapServices {
 		for _, service := range services {
-			if strings.Contains(service.Name, "dynatrace") &&
+			if strings.Contains(service.Name, serviceName) &&
 					service.Credentials["environmentid"] != "" &&
 					service.Credentials["apitoken"] != "" {
 				detectedServices = append(detectedServices, service)
@@ -153,29 +374,125 @@ func (h DynatraceHook) dtCredentials() map[string]string {
 		}
 	}
 
+	if len(detectedServices) > 1 {
+		if tag := os.Getenv("DT_SERVICE_TAG"); tag != "" {
+			var tagged []Service
+			for _, service := range detectedServices {
+				if service.Credentials["tag"] == tag {
+					tagged = append(tagged, service)
+				}
+			}
+			if len(tagged) == 0 {
+				h.Log.Warning("DT_SERVICE_TAG %q matched none of the %d candidate services", tag, len(detectedServices))
+			}
+			detectedServices = tagged
+		}
+	}
+
 	if len(detectedServices) == 1 {
 		h.Log.Debug("Found one matching service: %s", detectedServices[0].Name)
 		return detectedServices[0].Credentials
 	} else if len(detectedServices) > 1 {
-		h.Log.Warning("More than one matching service found!")
+		h.Log.Warning("More than one matching service found! Set DT_SERVICE_TAG to the 'tag' credential of the service to use.")
 	}
 
 	return nil
 }
 
+// vcapApplication holds the subset of VCAP_APPLICATION used to tag the
+// Dynatrace host with its place in the CF topology.
+type vcapApplication struct {
+	Name             string `json:"name"`
+	SpaceName        string `json:"space_name"`
+	OrganizationName string `json:"organization_name"`
+	ApplicationID    string `json:"application_id"`
+}
+
+func (h DynatraceHook) vcapApplication() vcapApplication {
+	var application vcapApplication
+	json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &application)
+	return application
+}
+
 func (h DynatraceHook) appName() string {
-	var application struct {
-		Name string `json:"name"`
+	return h.vcapApplication().Name
+}
+
+// downloadFile fetches rawurl to path, retrying transient network errors and
+// the status codes in retryableStatusCodes up to a "downloadretries"
+// credential (default defaultDownloadRetries) with exponential backoff and
+// jitter. Each attempt truncates and re-writes path from scratch.
+func (h DynatraceHook) downloadFile(rawurl, path string, credentials map[string]string) error {
+	maxAttempts := defaultDownloadRetries
+	if configured, present := credentials["downloadretries"]; present {
+		if parsed, err := strconv.Atoi(configured); err == nil && parsed >= 0 {
+			maxAttempts = parsed
+		} else {
+			h.Log.Warning("Ignoring invalid downloadretries credential '%s'", configured)
+		}
 	}
-	err := json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &application)
+
+	client, err := h.httpClient(credentials)
 	if err != nil {
-		return ""
+		return err
 	}
 
-	return application.Name
+	var lastErr error
+	for attempt := 0; attempt <= maxAttempts; attempt++ {
+		if attempt > 0 {
+			wait := retryBackoff(attempt, retryAfter(lastErr))
+			h.Log.Warning("Download attempt %d failed (%s), retrying in %s...", attempt, lastErr, wait)
+			time.Sleep(wait)
+		}
+
+		lastErr = h.attemptDownload(client, rawurl, path)
+		if lastErr == nil {
+			return nil
+		}
+
+		if _, retryable := lastErr.(retryableError); !retryable {
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+// retryableError marks a download failure as transient so downloadFile
+// retries it; it optionally carries a Retry-After duration from the server.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
 }
 
-func (h DynatraceHook) downloadFile(url, path string) error {
+func (e retryableError) Error() string { return e.err.Error() }
+
+func retryAfter(err error) time.Duration {
+	if retryErr, ok := err.(retryableError); ok {
+		return retryErr.retryAfter
+	}
+	return 0
+}
+
+// retryBackoff computes sleep = min(cap, base*2^attempt) + rand(0, base),
+// honoring an explicit Retry-After duration when the server provided one.
+func retryBackoff(attempt int, serverRetryAfter time.Duration) time.Duration {
+	if serverRetryAfter > 0 {
+		return serverRetryAfter
+	}
+
+	backoff := retryBackoffBase
+	for i := 0; i < attempt && backoff < retryBackoffCap; i++ {
+		backoff *= 2
+	}
+	if backoff > retryBackoffCap {
+		backoff = retryBackoffCap
+	}
+
+	return backoff + time.Duration(rand.Int63n(int64(retryBackoffBase)))
+}
+
+func (h DynatraceHook) attemptDownload(client *http.Client, rawurl, path string) error {
 	out, err := os.Create(path)
 	if err != nil {
 		return err
@@ -183,60 +500,178 @@ func (h DynatraceHook) downloadFile(url, path string) error {
 
 	defer out.Close()
 
-	resp, err := http.Get(url)
+	resp, err := client.Get(rawurl)
 	if err != nil {
-		return err
+		return retryableError{err: err}
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
-		return errors.New("Download returned with status " + resp.Status)
+		err := errors.New("Download returned with status " + resp.Status)
+		if retryableStatusCodes[resp.StatusCode] {
+			return retryableError{err: err, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		}
+		return err
 	}
 
-	defer resp.Body.Close()
-
 	_, err = io.Copy(out, resp.Body)
 	if err != nil {
-		return err
+		return retryableError{err: err}
 	}
 
 	return nil
 }
 
-func (h DynatraceHook) agentPath(installDir string) (string, error) {
-	manifestPath := filepath.Join(installDir, "manifest.json")
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when)
+	}
 
-	type Binary struct {
-		Path string `json:"path"`
-		Md5 string `json:"md5"`
-		Version string `json:"version"`
-		Binarytype string `json:"binarytype,omitempty"`
+	return 0
+}
+
+// httpClient builds an http.Client that honors HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+// from the environment, unless overridden by a "proxy" credential. A
+// "customcert" credential is added to the trusted root pool, and
+// "skipcertverify" disables TLS verification entirely (with a warning) for
+// operators pointing the hook at an internal API gateway.
+func (h DynatraceHook) httpClient(credentials map[string]string) (*http.Client, error) {
+	proxyConfig := httpproxy.FromEnvironment()
+	if proxy, present := credentials["proxy"]; present && proxy != "" {
+		proxyConfig = &httpproxy.Config{HTTPProxy: proxy, HTTPSProxy: proxy}
 	}
 
+	transport := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return proxyConfig.ProxyFunc()(req.URL)
+		},
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if customCert, present := credentials["customcert"]; present && customCert != "" {
+		pool, err := certPoolWithSystemRoots()
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM([]byte(customCert)) {
+			return nil, errors.New("Could not parse customcert credential as PEM")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if credentials["skipcertverify"] == "true" {
+		h.Log.Warning("Dynatrace installer TLS certificate verification is disabled!")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
+
+func certPoolWithSystemRoots() (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	return pool, nil
+}
+
+func (h DynatraceHook) agentPath(installDir, arch string) (Binary, error) {
+	manifestPath := filepath.Join(installDir, "manifest.json")
+
 	type Architecture map[string][]Binary
 	type Technologies map[string]Architecture
 
 	type Manifest struct {
-		Tech Technologies`json:"technologies"`
-		Ver string `json:"version"`
+		Tech Technologies `json:"technologies"`
+		Ver  string       `json:"version"`
 	}
 
 	var manifest Manifest
 
 	raw, err := ioutil.ReadFile(manifestPath)
 	if err != nil {
-		return "", err
+		return Binary{}, err
 	}
 
-	err = json.Unmarshal(raw, &manifest) 
+	err = json.Unmarshal(raw, &manifest)
 	if err != nil {
-		return "", err
+		return Binary{}, err
 	}
 
-	for _, binary := range manifest.Tech["process"]["linux-x86-64"] {
-		if binary.Binarytype ==	"primary" {
-			return binary.Path, nil
+	for _, binary := range manifest.Tech["process"][arch] {
+		if binary.Binarytype == "primary" {
+			return binary, nil
+		}
+	}
+
+	return Binary{}, errors.New("No primary binary for process agent found for architecture " + arch + "!")
+}
+
+// verifyAgentChecksum compares every known hash field on binary (see
+// hashAlgorithms) against the actual contents of the file at path. A blank
+// field is treated as "not provided by this manifest" and skipped. On
+// mismatch the error is returned unless skipErrors is "true", in which case
+// it is logged as a warning and the next algorithm is still checked.
+func (h DynatraceHook) verifyAgentChecksum(path string, binary Binary, skipErrors string) error {
+	v := reflect.ValueOf(binary)
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.ToLower(t.Field(i).Name)
+
+		newHash, ok := hashAlgorithms[name]
+		if !ok {
+			continue
+		}
+
+		expected := v.Field(i).String()
+		if expected == "" {
+			continue
+		}
+
+		actual, err := fileHash(path, newHash)
+		if err != nil {
+			return err
 		}
+
+		if !strings.EqualFold(actual, expected) {
+			msg := fmt.Sprintf("Agent library %s mismatch: expected %s, got %s", name, expected, actual)
+			if skipErrors == "true" {
+				h.Log.Warning("%s", msg)
+				continue
+			}
+			return errors.New(msg)
+		}
+
+		h.Log.Debug("Agent library %s checksum verified.", name)
+	}
+
+	return nil
+}
+
+func fileHash(path string, newHash func() hash.Hash) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	digest := newHash()
+	if _, err := io.Copy(digest, f); err != nil {
+		return "", err
 	}
 
-	return "", errors.New("No primary binary for process agent found!")
+	return hex.EncodeToString(digest.Sum(nil)), nil
 }